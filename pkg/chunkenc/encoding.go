@@ -0,0 +1,67 @@
+package chunkenc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Encoding is the identifier for a chunk encoding.
+type Encoding byte
+
+// The different available encodings.
+// Make sure to preserve the order, as any additions should be appended.
+const (
+	EncNone Encoding = iota
+	EncGZIP
+	EncDumb
+	EncLZ4
+	EncSnappy
+	EncZstd
+)
+
+var supportedEncoding = []Encoding{
+	EncNone,
+	EncGZIP,
+	EncLZ4,
+	EncSnappy,
+	EncZstd,
+}
+
+func (e Encoding) String() string {
+	switch e {
+	case EncGZIP:
+		return "gzip"
+	case EncNone:
+		return "none"
+	case EncLZ4:
+		return "lz4"
+	case EncSnappy:
+		return "snappy"
+	case EncZstd:
+		return "zstd"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseEncoding parses a chunk encoding (compression algorithm) by its name.
+func ParseEncoding(enc string) (Encoding, error) {
+	for _, e := range supportedEncoding {
+		if e.String() == enc {
+			return e, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid encoding: %s, supported: %s", enc, SupportedEncoding())
+}
+
+// SupportedEncoding returns the list of supported Encoding.
+func SupportedEncoding() string {
+	var sb strings.Builder
+	for i := range supportedEncoding {
+		sb.WriteString(supportedEncoding[i].String())
+		if i != len(supportedEncoding)-1 {
+			sb.WriteString(", ")
+		}
+	}
+	return sb.String()
+}
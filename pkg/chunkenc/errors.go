@@ -0,0 +1,11 @@
+package chunkenc
+
+import "errors"
+
+var (
+	// ErrOutOfOrder is returned when entries are appended out of order.
+	ErrOutOfOrder = errors.New("entry out of order")
+	// ErrInvalidChecksum is returned when a chunk or block checksum does not match
+	// the computed value.
+	ErrInvalidChecksum = errors.New("invalid chunk checksum")
+)
@@ -9,6 +9,7 @@ import (
 	"hash"
 	"hash/crc32"
 	"io"
+	"sort"
 	"time"
 
 	"github.com/pkg/errors"
@@ -29,6 +30,10 @@ var (
 
 	chunkFormatV1 = byte(1)
 	chunkFormatV2 = byte(2)
+	// chunkFormatV3 additionally persists structured per-entry metadata
+	// (key/value pairs such as extracted fields, trace IDs, severity)
+	// alongside each line.
+	chunkFormatV3 = byte(3)
 )
 
 // The table gets initialized with sync.Once but may still cause a race
@@ -46,6 +51,77 @@ func newCRC32() hash.Hash32 {
 	return crc32.New(castagnoliTable)
 }
 
+// CutMode controls how MemChunk decides where to cut a new block.
+type CutMode byte
+
+const (
+	// FixedCutMode cuts a block as soon as the head block reaches blockSize,
+	// the original behavior. Boundaries shift whenever an earlier entry in
+	// the stream changes.
+	FixedCutMode CutMode = iota
+	// ContentDefinedCutMode cuts a block at content-defined boundaries found
+	// by rolling a checksum over the serialized entry stream, so that
+	// re-ingested or slightly edited streams produce long runs of
+	// byte-identical blocks.
+	ContentDefinedCutMode
+)
+
+// ChunkOption configures optional MemChunk behavior at construction time.
+type ChunkOption func(*MemChunk)
+
+// WithContentDefinedCutting switches a MemChunk from fixed-size block cutting
+// to content-defined cutting. avgBlockSizeMask is the bitmask checked against
+// the rolling checksum; a cut happens once `(hash & avgBlockSizeMask) == 0`,
+// so its population count controls the target average block size (e.g. a
+// 16-bit mask targets ~64KiB blocks). minBlockSize and maxBlockSize clamp the
+// result so a pathological input can't produce unbounded or empty blocks.
+func WithContentDefinedCutting(avgBlockSizeMask uint32, minBlockSize, maxBlockSize int) ChunkOption {
+	return func(c *MemChunk) {
+		c.cutMode = ContentDefinedCutMode
+		c.cdcMask = avgBlockSizeMask
+		c.minBlockSize = minBlockSize
+		c.maxBlockSize = maxBlockSize
+		c.head.rh = newRollingHash()
+		c.head.cdcMask = avgBlockSizeMask
+	}
+}
+
+// WithStructuredMetadata upgrades a MemChunk to chunkFormatV3, which persists
+// structured per-entry key/value metadata (set via AppendWithMetadata)
+// alongside each line. Chunks without this option keep using chunkFormatV2
+// and drop any metadata passed to AppendWithMetadata.
+func WithStructuredMetadata() ChunkOption {
+	return func(c *MemChunk) {
+		c.format = chunkFormatV3
+	}
+}
+
+// WithReorderBuffer lets MemChunk.Append accept entries that arrive up to
+// window older than the head block's current maxt, instead of rejecting
+// them outright with ErrOutOfOrder. Such entries are held in a side buffer
+// and merged back into timestamp order, via a stable sort, when the head
+// block is cut. maxEntries bounds the side buffer so a pathologically
+// reordered stream can't grow it without limit; once either bound is
+// exceeded, out-of-order entries go back to being rejected.
+func WithReorderBuffer(window time.Duration, maxEntries int) ChunkOption {
+	return func(c *MemChunk) {
+		c.reorderWindow = window
+		c.maxReorderEntries = maxEntries
+		c.head.reorderWindow = window
+		c.head.maxReorderEntries = maxEntries
+	}
+}
+
+// AllowBlockRewrite lets an out-of-order entry that would land in an
+// already-cut block decompress that block, merge the entry in timestamp
+// order, and recompress it in place instead of being rejected with
+// ErrOutOfOrder.
+func AllowBlockRewrite() ChunkOption {
+	return func(c *MemChunk) {
+		c.allowBlockRewrite = true
+	}
+}
+
 // MemChunk implements compressed log chunks.
 type MemChunk struct {
 	// The number of uncompressed bytes per block.
@@ -65,6 +141,20 @@ type MemChunk struct {
 	format   byte
 	encoding Encoding
 
+	// cutMode selects how the head block decides to cut itself; cdcMask,
+	// minBlockSize and maxBlockSize only apply in ContentDefinedCutMode.
+	cutMode                    CutMode
+	cdcMask                    uint32
+	minBlockSize, maxBlockSize int
+
+	// reorderWindow and maxReorderEntries bound how far out of order an
+	// entry can arrive before ErrOutOfOrder, see WithReorderBuffer.
+	reorderWindow     time.Duration
+	maxReorderEntries int
+	// allowBlockRewrite enables recompressing an already-cut block to merge
+	// in an out-of-order entry instead of rejecting it, see AllowBlockRewrite.
+	allowBlockRewrite bool
+
 	readers ReaderPool
 	writers WriterPool
 }
@@ -78,8 +168,28 @@ type block struct {
 
 	offset           int // The offset of the block in the chunk.
 	uncompressedSize int // Total uncompressed size in bytes when the chunk is cut.
+
+	// index is a sparse index into the uncompressed entry stream, recorded
+	// every indexEntryEvery entries, used to skip decoding entries before
+	// the first one that could satisfy a query's mint. The block is still
+	// decompressed up to that offset -- only per-entry decoding and
+	// allocation are skipped.
+	index []indexEntry
 }
 
+// indexEntry is one sample point of a block's sparse index: the byte offset
+// of an entry within the block's uncompressed stream, and that entry's
+// timestamp.
+type indexEntry struct {
+	uncompressedOffset int
+	timestamp          int64
+}
+
+// indexEntryEvery controls how densely a block's sparse index is sampled;
+// smaller values skip decoding more entries before mint at the cost of a
+// larger footer.
+const indexEntryEvery = 64
+
 // This block holds the un-compressed entries. Once it has enough data, this is
 // emptied into a block with only compressed entries.
 type headBlock struct {
@@ -88,6 +198,20 @@ type headBlock struct {
 	size    int // size of uncompressed bytes.
 
 	mint, maxt int64
+
+	// rh is non-nil when the chunk uses ContentDefinedCutMode; it rolls over
+	// the serialized entry stream to find a content-defined cut point.
+	rh      *rollingHash
+	cdcMask uint32
+	// cut is set by rh once it finds a cut point; cleared again on cut().
+	cut bool
+
+	// sideEntries holds entries that arrived within reorderWindow of maxt
+	// but out of order; they are merged back into entries, via a stable
+	// sort, when the block is cut. See WithReorderBuffer.
+	sideEntries       []entry
+	reorderWindow     time.Duration
+	maxReorderEntries int
 }
 
 func (hb *headBlock) isEmpty() bool {
@@ -95,27 +219,105 @@ func (hb *headBlock) isEmpty() bool {
 }
 
 func (hb *headBlock) append(ts int64, line string) error {
+	return hb.appendWithMetadata(ts, line, nil)
+}
+
+func (hb *headBlock) appendWithMetadata(ts int64, line string, metadata []entryMetadata) error {
 	if !hb.isEmpty() && hb.maxt > ts {
-		return ErrOutOfOrder
+		if !hb.withinReorderBuffer(ts) {
+			return ErrOutOfOrder
+		}
+
+		hb.sideEntries = append(hb.sideEntries, entry{t: ts, s: line, metadata: metadata})
+		if hb.mint > ts {
+			hb.mint = ts
+		}
+		hb.size += len(line)
+		return nil
 	}
 
-	hb.entries = append(hb.entries, entry{ts, line})
+	hb.entries = append(hb.entries, entry{t: ts, s: line, metadata: metadata})
 	if hb.mint == 0 || hb.mint > ts {
 		hb.mint = ts
 	}
 	hb.maxt = ts
 	hb.size += len(line)
 
+	if hb.rh != nil {
+		hb.rollEntry(ts, line)
+	}
+
 	return nil
 }
 
-func (hb *headBlock) serialise(pool WriterPool) ([]byte, error) {
+// withinReorderBuffer reports whether an out-of-order entry at ts can be
+// held in the side buffer rather than rejected with ErrOutOfOrder.
+func (hb *headBlock) withinReorderBuffer(ts int64) bool {
+	if hb.reorderWindow <= 0 {
+		return false
+	}
+	if len(hb.sideEntries) >= hb.maxReorderEntries {
+		return false
+	}
+	return hb.maxt-ts <= int64(hb.reorderWindow)
+}
+
+// rollEntry feeds the same ts||len||line byte stream that serialise() writes
+// into the rolling checksum, so the cut point only depends on the bytes that
+// end up on disk and not on how callers batch their Append calls.
+func (hb *headBlock) rollEntry(ts int64, line string) {
+	var buf [binary.MaxVarintLen64]byte
+
+	n := binary.PutVarint(buf[:], ts)
+	for _, b := range buf[:n] {
+		hb.roll(b)
+	}
+
+	n = binary.PutUvarint(buf[:], uint64(len(line)))
+	for _, b := range buf[:n] {
+		hb.roll(b)
+	}
+
+	for i := 0; i < len(line); i++ {
+		hb.roll(line[i])
+	}
+}
+
+func (hb *headBlock) roll(b byte) {
+	if hb.rh.roll(b)&hb.cdcMask == 0 {
+		hb.cut = true
+	}
+}
+
+// serialise compresses the head block's entries and returns the compressed
+// bytes along with a sparse index sampled every indexEntryEvery entries, so
+// a reader can later skip decoding entries before the one nearest a query's
+// mint. The compressed stream still has to be decompressed up to that
+// point; only entry decoding and allocation are avoided.
+func (hb *headBlock) serialise(pool WriterPool, format byte) ([]byte, []indexEntry, error) {
 	inBuf := serializeBytesBufferPool.Get().(*bytes.Buffer)
 	outBuf := &bytes.Buffer{}
 
+	entries := hb.entries
+	if len(hb.sideEntries) > 0 {
+		merged := make([]entry, 0, len(hb.entries)+len(hb.sideEntries))
+		merged = append(merged, hb.entries...)
+		merged = append(merged, hb.sideEntries...)
+		sort.SliceStable(merged, func(i, j int) bool { return merged[i].t < merged[j].t })
+		entries = merged
+	}
+
+	var index []indexEntry
 	encBuf := make([]byte, binary.MaxVarintLen64)
 	compressedWriter := pool.GetWriter(outBuf)
-	for _, logEntry := range hb.entries {
+	for i, logEntry := range entries {
+		if i%indexEntryEvery == 0 {
+			index = append(index, indexEntry{
+				uncompressedOffset: inBuf.Len(),
+				timestamp:          logEntry.t,
+			})
+		}
+
 		n := binary.PutVarint(encBuf, logEntry.t)
 		inBuf.Write(encBuf[:n])
 
@@ -123,25 +325,49 @@ func (hb *headBlock) serialise(pool WriterPool) ([]byte, error) {
 		inBuf.Write(encBuf[:n])
 
 		inBuf.WriteString(logEntry.s)
+
+		if format >= chunkFormatV3 {
+			n = binary.PutUvarint(encBuf, uint64(len(logEntry.metadata)))
+			inBuf.Write(encBuf[:n])
+
+			for _, kv := range logEntry.metadata {
+				n = binary.PutUvarint(encBuf, uint64(len(kv.key)))
+				inBuf.Write(encBuf[:n])
+				inBuf.WriteString(kv.key)
+
+				n = binary.PutUvarint(encBuf, uint64(len(kv.value)))
+				inBuf.Write(encBuf[:n])
+				inBuf.WriteString(kv.value)
+			}
+		}
 	}
 
 	if _, err := compressedWriter.Write(inBuf.Bytes()); err != nil {
-		return nil, errors.Wrap(err, "appending entry")
+		return nil, nil, errors.Wrap(err, "appending entry")
 	}
 	if err := compressedWriter.Close(); err != nil {
-		return nil, errors.Wrap(err, "flushing pending compress buffer")
+		return nil, nil, errors.Wrap(err, "flushing pending compress buffer")
 	}
 
 	inBuf.Reset()
 	serializeBytesBufferPool.Put(inBuf)
 
 	pool.PutWriter(compressedWriter)
-	return outBuf.Bytes(), nil
+	return outBuf.Bytes(), index, nil
 }
 
 type entry struct {
 	t int64
 	s string
+	// metadata holds structured key/value pairs carried alongside the line
+	// (e.g. extracted fields, trace IDs, severity). Only persisted when the
+	// chunk uses chunkFormatV3 or later.
+	metadata []entryMetadata
+}
+
+// entryMetadata is a single structured key/value pair attached to an entry.
+type entryMetadata struct {
+	key, value string
 }
 
 // NewMemChunk returns a new in-mem chunk for query.
@@ -150,8 +376,10 @@ func NewMemChunk(enc Encoding) *MemChunk {
 }
 
 // NewMemChunkSize returns a new in-mem chunk.
-// Mainly for config push size.
-func NewMemChunkSize(enc Encoding, blockSize, targetSize int) *MemChunk {
+// Mainly for config push size. opts may be used to switch on optional
+// behavior such as content-defined block cutting; with no opts the chunk
+// keeps the default FixedCutMode behavior.
+func NewMemChunkSize(enc Encoding, blockSize, targetSize int, opts ...ChunkOption) *MemChunk {
 	c := &MemChunk{
 		blockSize:  blockSize,  // The blockSize in bytes.
 		targetSize: targetSize, // Desired chunk size in compressed bytes
@@ -165,6 +393,10 @@ func NewMemChunkSize(enc Encoding, blockSize, targetSize int) *MemChunk {
 		readers:  getReaderPool(enc),
 	}
 
+	for _, opt := range opts {
+		opt(c)
+	}
+
 	return c
 }
 
@@ -187,8 +419,8 @@ func NewByteChunk(b []byte) (*MemChunk, error) {
 	switch version {
 	case chunkFormatV1:
 		bc.readers, bc.writers = &Gzip, &Gzip
-	case chunkFormatV2:
-		// format v2 has a byte for block encoding.
+	case chunkFormatV2, chunkFormatV3:
+		// format v2+ has a byte for block encoding.
 		enc := Encoding(db.byte())
 		if db.err() != nil {
 			return nil, errors.Wrap(db.err(), "verifying encoding")
@@ -232,6 +464,20 @@ func NewByteChunk(b []byte) (*MemChunk, error) {
 			return bc, ErrInvalidChecksum
 		}
 
+		// The sparse entry index was only added in chunkFormatV3; earlier
+		// formats have nothing to read here.
+		if bc.format >= chunkFormatV3 {
+			if numIdx := db.uvarint(); numIdx > 0 {
+				blk.index = make([]indexEntry, 0, numIdx)
+				for j := 0; j < numIdx; j++ {
+					blk.index = append(blk.index, indexEntry{
+						uncompressedOffset: db.uvarint(),
+						timestamp:          db.varint64(),
+					})
+				}
+			}
+		}
+
 		bc.blocks = append(bc.blocks, blk)
 
 		if db.err() != nil {
@@ -242,17 +488,162 @@ func NewByteChunk(b []byte) (*MemChunk, error) {
 	return bc, nil
 }
 
+// sizedReaderAt is satisfied by an io.ReaderAt that also knows its own
+// total size, e.g. *bytes.Reader -- enough to read the fixed-size footer
+// directly from the tail instead of buffering the whole chunk to find it.
+type sizedReaderAt interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// ReadChunkFrom is the symmetric counterpart to MemChunk.WriteTo. When r
+// also implements sizedReaderAt, it reads the footer straight from the tail
+// and then each block by its offset into a slice of its own, without ever
+// copying the whole stream into one buffer; all block bytes are still read
+// up front and held by the returned chunk. For a plain io.Reader the footer's offset isn't
+// knowable until the stream has been fully consumed, so this falls back to
+// buffering it and decoding via NewByteChunk.
+func ReadChunkFrom(r io.Reader) (*MemChunk, error) {
+	ra, ok := r.(sizedReaderAt)
+	if !ok {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading chunk")
+		}
+		return NewByteChunk(b)
+	}
+	return readChunkFromReaderAt(ra)
+}
+
+func readChunkFromReaderAt(ra sizedReaderAt) (*MemChunk, error) {
+	size := ra.Size()
+	if size < 8+4 {
+		return nil, errors.New("chunk too small")
+	}
+
+	header := make([]byte, 5)
+	if _, err := ra.ReadAt(header, 0); err != nil {
+		return nil, errors.Wrap(err, "reading header")
+	}
+
+	db := decbuf{b: header}
+	m, version := db.be32(), db.byte()
+	if db.err() != nil {
+		return nil, errors.Wrap(db.err(), "verifying header")
+	}
+	if m != magicNumber {
+		return nil, errors.Errorf("invalid magic number %x", m)
+	}
+
+	bc := &MemChunk{
+		head:   &headBlock{}, // Dummy, empty headblock.
+		format: version,
+	}
+	switch version {
+	case chunkFormatV1:
+		bc.readers, bc.writers = &Gzip, &Gzip
+	case chunkFormatV2, chunkFormatV3:
+		encByte := make([]byte, 1)
+		if _, err := ra.ReadAt(encByte, 5); err != nil {
+			return nil, errors.Wrap(err, "reading encoding")
+		}
+		bc.encoding = Encoding(encByte[0])
+		bc.readers, bc.writers = getReaderPool(bc.encoding), getWriterPool(bc.encoding)
+	default:
+		return nil, errors.Errorf("invalid version %d", version)
+	}
+
+	tail := make([]byte, 8)
+	if _, err := ra.ReadAt(tail, size-8); err != nil {
+		return nil, errors.Wrap(err, "reading metasOffset")
+	}
+	metasOffset := int64(binary.BigEndian.Uint64(tail))
+
+	footer := make([]byte, size-metasOffset-8)
+	if _, err := ra.ReadAt(footer, metasOffset); err != nil {
+		return nil, errors.Wrap(err, "reading footer")
+	}
+
+	mb := footer[:len(footer)-4]
+	expCRC := binary.BigEndian.Uint32(footer[len(footer)-4:])
+	mdb := decbuf{b: mb}
+	if expCRC != mdb.crc32() {
+		return nil, ErrInvalidChecksum
+	}
+
+	num := mdb.uvarint()
+	bc.blocks = make([]block, 0, num)
+
+	for i := 0; i < num; i++ {
+		blk := block{}
+		blk.numEntries = mdb.uvarint()
+		blk.mint = mdb.varint64()
+		blk.maxt = mdb.varint64()
+		blk.offset = mdb.uvarint()
+		l := mdb.uvarint()
+
+		blk.b = make([]byte, l)
+		if _, err := ra.ReadAt(blk.b, int64(blk.offset)); err != nil {
+			return nil, errors.Wrap(err, "reading block")
+		}
+
+		crcBuf := make([]byte, 4)
+		if _, err := ra.ReadAt(crcBuf, int64(blk.offset+l)); err != nil {
+			return nil, errors.Wrap(err, "reading block checksum")
+		}
+		if binary.BigEndian.Uint32(crcBuf) != crc32.Checksum(blk.b, castagnoliTable) {
+			return bc, ErrInvalidChecksum
+		}
+
+		// The sparse entry index was only added in chunkFormatV3; earlier
+		// formats have nothing to read here.
+		if bc.format >= chunkFormatV3 {
+			if numIdx := mdb.uvarint(); numIdx > 0 {
+				blk.index = make([]indexEntry, 0, numIdx)
+				for j := 0; j < numIdx; j++ {
+					blk.index = append(blk.index, indexEntry{
+						uncompressedOffset: mdb.uvarint(),
+						timestamp:          mdb.varint64(),
+					})
+				}
+			}
+		}
+
+		bc.blocks = append(bc.blocks, blk)
+
+		if mdb.err() != nil {
+			return nil, errors.Wrap(mdb.err(), "decoding block meta")
+		}
+	}
+
+	return bc, nil
+}
+
 // Bytes implements Chunk.
 func (c *MemChunk) Bytes() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if _, err := c.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteTo implements io.WriterTo. It streams the header, each already
+// compressed block read straight out of its backing byte slice, and the
+// block-meta footer directly to w, one write at a time, instead of
+// materializing the whole chunk in a single buffer first -- which matters
+// for multi-MB targetSize chunks flushed to object storage. Bytes() is kept
+// as a thin wrapper around it for callers that still want a []byte.
+func (c *MemChunk) WriteTo(w io.Writer) (int64, error) {
 	if c.head != nil {
-		// When generating the bytes, we need to flush the data held in-buffer.
+		// When flushing, we need to cut the data held in-buffer.
 		if err := c.cut(); err != nil {
-			return nil, err
+			return 0, err
 		}
 	}
 	crc32Hash := newCRC32()
 
-	buf := bytes.NewBuffer(nil)
+	var total int64
 	offset := 0
 
 	eb := encbuf{b: make([]byte, 0, 1<<10)}
@@ -260,29 +651,39 @@ func (c *MemChunk) Bytes() ([]byte, error) {
 	// Write the header (magicNum + version).
 	eb.putBE32(magicNumber)
 	eb.putByte(c.format)
-	if c.format == chunkFormatV2 {
-		// chunk format v2 has a byte for encoding.
+	if c.format == chunkFormatV2 || c.format == chunkFormatV3 {
+		// chunk format v2+ has a byte for encoding.
 		eb.putByte(byte(c.encoding))
 	}
 
-	n, err := buf.Write(eb.get())
+	n, err := w.Write(eb.get())
 	if err != nil {
-		return buf.Bytes(), errors.Wrap(err, "write blockMeta #entries")
+		return total, errors.Wrap(err, "write header")
 	}
+	total += int64(n)
 	offset += n
 
 	// Write Blocks.
 	for i, b := range c.blocks {
 		c.blocks[i].offset = offset
 
+		n, err := w.Write(b.b)
+		if err != nil {
+			return total, errors.Wrap(err, "write block")
+		}
+		total += int64(n)
+		offset += n
+
+		crc32Hash.Reset()
+		_, _ = crc32Hash.Write(b.b)
 		eb.reset()
-		eb.putBytes(b.b)
-		eb.putHash(crc32Hash)
+		eb.putBE32(crc32Hash.Sum32())
 
-		n, err := buf.Write(eb.get())
+		n, err = w.Write(eb.get())
 		if err != nil {
-			return buf.Bytes(), errors.Wrap(err, "write block")
+			return total, errors.Wrap(err, "write block checksum")
 		}
+		total += int64(n)
 		offset += n
 	}
 
@@ -291,30 +692,42 @@ func (c *MemChunk) Bytes() ([]byte, error) {
 	eb.reset()
 	eb.putUvarint(len(c.blocks))
 
-	// Write BlockMetas.
+	// Write BlockMetas, each followed by its sparse entry index. The index
+	// is only emitted for chunkFormatV3+; writing it for v1/v2 would shift
+	// every field after it for readers that predate this series.
 	for _, b := range c.blocks {
 		eb.putUvarint(b.numEntries)
 		eb.putVarint64(b.mint)
 		eb.putVarint64(b.maxt)
 		eb.putUvarint(b.offset)
 		eb.putUvarint(len(b.b))
+
+		if c.format >= chunkFormatV3 {
+			eb.putUvarint(len(b.index))
+			for _, ix := range b.index {
+				eb.putUvarint(ix.uncompressedOffset)
+				eb.putVarint64(ix.timestamp)
+			}
+		}
 	}
 	eb.putHash(crc32Hash)
 
-	_, err = buf.Write(eb.get())
+	n, err = w.Write(eb.get())
 	if err != nil {
-		return buf.Bytes(), errors.Wrap(err, "write block metas")
+		return total, errors.Wrap(err, "write block metas")
 	}
+	total += int64(n)
 
 	// Write the metasOffset.
 	eb.reset()
 	eb.putBE64int(metasOffset)
-	_, err = buf.Write(eb.get())
+	n, err = w.Write(eb.get())
 	if err != nil {
-		return buf.Bytes(), errors.Wrap(err, "write metasOffset")
+		return total, errors.Wrap(err, "write metasOffset")
 	}
+	total += int64(n)
 
-	return buf.Bytes(), nil
+	return total, nil
 }
 
 // Encoding implements Chunk.
@@ -391,25 +804,151 @@ func (c *MemChunk) Utilization() float64 {
 
 // Append implements Chunk.
 func (c *MemChunk) Append(entry *logproto.Entry) error {
-	entryTimestamp := entry.Timestamp.UnixNano()
+	return c.append(entry.Timestamp.UnixNano(), entry.Line, nil)
+}
+
+// AppendWithMetadata behaves like Append but additionally attaches structured
+// key/value metadata to the entry (e.g. extracted fields, trace IDs,
+// severity). Metadata is only persisted by chunks created with
+// WithStructuredMetadata; other chunks silently drop it, since their format
+// has no room to store it.
+func (c *MemChunk) AppendWithMetadata(entry *logproto.Entry, metadata map[string]string) error {
+	return c.append(entry.Timestamp.UnixNano(), entry.Line, toEntryMetadata(metadata))
+}
 
+func (c *MemChunk) append(ts int64, line string, metadata []entryMetadata) error {
 	// If the head block is empty but there are cut blocks, we have to make
 	// sure the new entry is not out of order compared to the previous block
-	if c.head.isEmpty() && len(c.blocks) > 0 && c.blocks[len(c.blocks)-1].maxt > entryTimestamp {
+	// With a reorder buffer the head may be non-empty here too: an entry
+	// older than the last cut block's maxt is never held in the side buffer.
+	if len(c.blocks) > 0 && c.blocks[len(c.blocks)-1].maxt > ts {
+		if c.allowBlockRewrite {
+			return c.rewriteBlockWith(ts, line, metadata)
+		}
 		return ErrOutOfOrder
 	}
 
-	if err := c.head.append(entryTimestamp, entry.Line); err != nil {
+	if c.format < chunkFormatV3 {
+		metadata = nil
+	}
+	if err := c.head.appendWithMetadata(ts, line, metadata); err != nil {
 		return err
 	}
 
-	if c.head.size >= c.blockSize {
+	if c.shouldCut() {
 		return c.cut()
 	}
 
 	return nil
 }
 
+// rewriteBlockWith decompresses the already-cut block that ts falls within,
+// merges the new entry into it in timestamp order, and recompresses it in
+// place. Used by Append/AppendWithMetadata when AllowBlockRewrite is set and
+// an entry arrives too late for the reorder buffer to absorb.
+func (c *MemChunk) rewriteBlockWith(ts int64, line string, metadata []entryMetadata) error {
+	idx := -1
+	for i, b := range c.blocks {
+		if b.maxt >= ts {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return ErrOutOfOrder
+	}
+	// Merging ts into block idx would pull that block's mint below the
+	// previous block's maxt, producing overlapping blocks that
+	// NewNonOverlappingIterator does not expect. Reject rather than risk
+	// out-of-order query output.
+	if idx > 0 && ts < c.blocks[idx-1].maxt {
+		return ErrOutOfOrder
+	}
+
+	entries, err := decodeBlockEntries(c.blocks[idx], c.readers, c.format)
+	if err != nil {
+		return errors.Wrap(err, "decoding block for rewrite")
+	}
+
+	entries = append(entries, entry{t: ts, s: line, metadata: metadata})
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].t < entries[j].t })
+
+	tmp := &headBlock{entries: entries}
+	b, index, err := tmp.serialise(c.writers, c.format)
+	if err != nil {
+		return errors.Wrap(err, "recompressing rewritten block")
+	}
+
+	old := c.blocks[idx]
+	c.cutBlockSize += len(b) - len(old.b)
+
+	c.blocks[idx] = block{
+		b:                b,
+		numEntries:       len(entries),
+		mint:             entries[0].t,
+		maxt:             entries[len(entries)-1].t,
+		uncompressedSize: old.uncompressedSize + len(line),
+		index:            index,
+	}
+
+	return nil
+}
+
+func toEntryMetadata(m map[string]string) []entryMetadata {
+	if len(m) == 0 {
+		return nil
+	}
+	out := make([]entryMetadata, 0, len(m))
+	for k, v := range m {
+		out = append(out, entryMetadata{key: k, value: v})
+	}
+	return out
+}
+
+// metadataToMap converts structured metadata back to the map[string]string
+// shape used by AppendWithMetadata and StructuredMetadataFilter.
+func metadataToMap(metadata []entryMetadata) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(metadata))
+	for _, kv := range metadata {
+		out[kv.key] = kv.value
+	}
+	return out
+}
+
+// toLabelAdapters converts structured metadata to the
+// []logproto.LabelAdapter shape logproto.Entry.StructuredMetadata expects.
+func toLabelAdapters(metadata []entryMetadata) []logproto.LabelAdapter {
+	if len(metadata) == 0 {
+		return nil
+	}
+	out := make([]logproto.LabelAdapter, 0, len(metadata))
+	for _, kv := range metadata {
+		out = append(out, logproto.LabelAdapter{Name: kv.key, Value: kv.value})
+	}
+	return out
+}
+
+// StructuredMetadataFilter matches an entry against its structured metadata
+// (see AppendWithMetadata). It complements logql.Filter, which only sees the
+// line, letting a query match on extracted fields, trace IDs, severity, etc.
+// that were never part of the line itself.
+type StructuredMetadataFilter func(metadata map[string]string) bool
+
+// shouldCut reports whether the head block has reached a cut point under the
+// chunk's configured CutMode.
+func (c *MemChunk) shouldCut() bool {
+	if c.cutMode != ContentDefinedCutMode {
+		return c.head.size >= c.blockSize
+	}
+	if c.head.size >= c.maxBlockSize {
+		return true
+	}
+	return c.head.cut && c.head.size >= c.minBlockSize
+}
+
 // Close implements Chunk.
 // TODO: Fix this to check edge cases.
 func (c *MemChunk) Close() error {
@@ -422,24 +961,33 @@ func (c *MemChunk) cut() error {
 		return nil
 	}
 
-	b, err := c.head.serialise(c.writers)
+	b, index, err := c.head.serialise(c.writers, c.format)
 	if err != nil {
 		return err
 	}
 
 	c.blocks = append(c.blocks, block{
-		b:                b,
-		numEntries:       len(c.head.entries),
+		b: b,
+		// serialise merges sideEntries (out-of-order entries absorbed by the
+		// reorder buffer, see WithReorderBuffer) into the entries it writes,
+		// so numEntries must account for both.
+		numEntries:       len(c.head.entries) + len(c.head.sideEntries),
 		mint:             c.head.mint,
 		maxt:             c.head.maxt,
 		uncompressedSize: c.head.size,
+		index:            index,
 	})
 
 	c.cutBlockSize += len(b)
 
 	c.head.entries = c.head.entries[:0]
+	c.head.sideEntries = c.head.sideEntries[:0]
 	c.head.mint = 0 // Will be set on first append.
 	c.head.size = 0
+	c.head.cut = false
+	if c.head.rh != nil {
+		c.head.rh.reset()
+	}
 
 	return nil
 }
@@ -467,17 +1015,30 @@ func (c *MemChunk) Bounds() (fromT, toT time.Time) {
 
 // Iterator implements Chunk.
 func (c *MemChunk) Iterator(ctx context.Context, mintT, maxtT time.Time, direction logproto.Direction, filter logql.Filter) (iter.EntryIterator, error) {
+	return c.iterator(ctx, mintT, maxtT, direction, filter, nil)
+}
+
+// IteratorWithStructuredMetadata is like Iterator but additionally filters
+// entries on their structured metadata (see AppendWithMetadata).
+// On chunks that weren't created with WithStructuredMetadata,
+// metadataFilter is called with a nil map for every entry, since those
+// carry no metadata to filter on.
+func (c *MemChunk) IteratorWithStructuredMetadata(ctx context.Context, mintT, maxtT time.Time, direction logproto.Direction, filter logql.Filter, metadataFilter StructuredMetadataFilter) (iter.EntryIterator, error) {
+	return c.iterator(ctx, mintT, maxtT, direction, filter, metadataFilter)
+}
+
+func (c *MemChunk) iterator(ctx context.Context, mintT, maxtT time.Time, direction logproto.Direction, filter logql.Filter, metadataFilter StructuredMetadataFilter) (iter.EntryIterator, error) {
 	mint, maxt := mintT.UnixNano(), maxtT.UnixNano()
 	its := make([]iter.EntryIterator, 0, len(c.blocks)+1)
 
 	for _, b := range c.blocks {
 		if maxt > b.mint && b.maxt > mint {
-			its = append(its, b.iterator(ctx, c.readers, filter))
+			its = append(its, b.iterator(ctx, c.readers, mint, c.format, filter, metadataFilter))
 		}
 	}
 
 	if !c.head.isEmpty() {
-		its = append(its, c.head.iterator(mint, maxt, filter))
+		its = append(its, c.head.iterator(mint, maxt, filter, metadataFilter))
 	}
 
 	iterForward := iter.NewTimeRangedIterator(
@@ -493,14 +1054,96 @@ func (c *MemChunk) Iterator(ctx context.Context, mintT, maxtT time.Time, directi
 	return iter.NewReversedIter(iterForward, 0, false)
 }
 
-func (b block) iterator(ctx context.Context, pool ReaderPool, filter logql.Filter) iter.EntryIterator {
+func (b block) iterator(ctx context.Context, pool ReaderPool, mint int64, format byte, filter logql.Filter, metadataFilter StructuredMetadataFilter) iter.EntryIterator {
 	if len(b.b) == 0 {
 		return emptyIterator
 	}
-	return newBufferedIterator(ctx, pool, b.b, filter)
+	return newBufferedIterator(ctx, pool, b.b, filter, metadataFilter, b.skipToOffset(mint), format)
+}
+
+// skipToOffset returns the uncompressed byte offset of the latest indexed
+// entry strictly before mint, so the iterator can discard straight past it
+// instead of decoding every entry from the start of the block. mint is
+// inclusive, so a sample timestamped exactly mint is never skipped past --
+// otherwise entries sharing that timestamp but preceding the sampled one in
+// the block would be dropped from the result.
+func (b block) skipToOffset(mint int64) int {
+	skip := 0
+	for _, ix := range b.index {
+		if ix.timestamp >= mint {
+			break
+		}
+		skip = ix.uncompressedOffset
+	}
+	return skip
+}
+
+// decodeBlockEntries fully decompresses b and decodes every entry, including
+// any chunkFormatV3 structured metadata. Unlike bufferedIterator it is not
+// streaming and keeps the whole block in memory; it exists for the rare
+// block-rewrite path (see AllowBlockRewrite) where all entries need to be
+// held at once anyway in order to merge and resort them.
+func decodeBlockEntries(b block, pool ReaderPool, format byte) ([]entry, error) {
+	reader := pool.GetReader(bytes.NewBuffer(b.b))
+	defer pool.PutReader(reader)
+	br := bufio.NewReader(reader)
+
+	entries := make([]entry, 0, b.numEntries)
+	for {
+		ts, err := binary.ReadVarint(br)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		line, err := readLenPrefixed(br)
+		if err != nil {
+			return nil, err
+		}
+
+		var metadata []entryMetadata
+		if format >= chunkFormatV3 {
+			n, err := binary.ReadUvarint(br)
+			if err != nil {
+				return nil, err
+			}
+			if n > 0 {
+				metadata = make([]entryMetadata, 0, n)
+				for i := uint64(0); i < n; i++ {
+					key, err := readLenPrefixed(br)
+					if err != nil {
+						return nil, err
+					}
+					value, err := readLenPrefixed(br)
+					if err != nil {
+						return nil, err
+					}
+					metadata = append(metadata, entryMetadata{key: key, value: value})
+				}
+			}
+		}
+
+		entries = append(entries, entry{t: ts, s: line, metadata: metadata})
+	}
+	return entries, nil
+}
+
+// readLenPrefixed reads a uvarint length followed by that many bytes.
+func readLenPrefixed(br *bufio.Reader) (string, error) {
+	l, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
 }
 
-func (hb *headBlock) iterator(mint, maxt int64, filter logql.Filter) iter.EntryIterator {
+func (hb *headBlock) iterator(mint, maxt int64, filter logql.Filter, metadataFilter StructuredMetadataFilter) iter.EntryIterator {
 	if hb.isEmpty() || (maxt < hb.mint || hb.maxt < mint) {
 		return emptyIterator
 	}
@@ -510,11 +1153,27 @@ func (hb *headBlock) iterator(mint, maxt int64, filter logql.Filter) iter.EntryI
 	// but the tradeoff is that queries to near-realtime data would be much lower than
 	// cutting of blocks.
 
-	entries := make([]entry, 0, len(hb.entries))
-	for _, e := range hb.entries {
-		if filter == nil || filter([]byte(e.s)) {
-			entries = append(entries, e)
+	// sideEntries holds out-of-order entries the reorder buffer has already
+	// accepted (see WithReorderBuffer); they aren't merged into hb.entries
+	// until cut(), so they must be included here too or they'd be invisible
+	// to queries until the block is cut.
+	all := hb.entries
+	if len(hb.sideEntries) > 0 {
+		all = make([]entry, 0, len(hb.entries)+len(hb.sideEntries))
+		all = append(all, hb.entries...)
+		all = append(all, hb.sideEntries...)
+		sort.SliceStable(all, func(i, j int) bool { return all[i].t < all[j].t })
+	}
+
+	entries := make([]entry, 0, len(all))
+	for _, e := range all {
+		if filter != nil && !filter([]byte(e.s)) {
+			continue
+		}
+		if metadataFilter != nil && !metadataFilter(metadataToMap(e.metadata)) {
+			continue
 		}
+		entries = append(entries, e)
 	}
 
 	if len(entries) == 0 {
@@ -548,8 +1207,9 @@ func (li *listIterator) Entry() logproto.Entry {
 	cur := li.entries[li.cur]
 
 	return logproto.Entry{
-		Timestamp: time.Unix(0, cur.t),
-		Line:      cur.s,
+		Timestamp:          time.Unix(0, cur.t),
+		Line:               cur.s,
+		StructuredMetadata: toLabelAdapters(cur.metadata),
 	}
 }
 
@@ -575,18 +1235,30 @@ type bufferedIterator struct {
 
 	closed bool
 
-	filter logql.Filter
+	filter         logql.Filter
+	metadataFilter StructuredMetadataFilter
+
+	// skip is the number of uncompressed bytes to discard before decoding
+	// the first entry, used to jump past entries that can't satisfy mint.
+	skip int
+
+	// format is the chunk format the block was serialised with; it decides
+	// whether a structured metadata section follows each line.
+	format byte
 }
 
-func newBufferedIterator(ctx context.Context, pool ReaderPool, b []byte, filter logql.Filter) *bufferedIterator {
+func newBufferedIterator(ctx context.Context, pool ReaderPool, b []byte, filter logql.Filter, metadataFilter StructuredMetadataFilter, skip int, format byte) *bufferedIterator {
 	return &bufferedIterator{
-		rootCtx:   ctx,
-		origBytes: b,
-		reader:    nil, // will be initialized later
-		bufReader: nil, // will be initialized later
-		pool:      pool,
-		filter:    filter,
-		decBuf:    make([]byte, binary.MaxVarintLen64),
+		rootCtx:        ctx,
+		origBytes:      b,
+		reader:         nil, // will be initialized later
+		bufReader:      nil, // will be initialized later
+		pool:           pool,
+		filter:         filter,
+		metadataFilter: metadataFilter,
+		decBuf:         make([]byte, binary.MaxVarintLen64),
+		skip:           skip,
+		format:         format,
 	}
 }
 
@@ -595,10 +1267,22 @@ func (si *bufferedIterator) Next() bool {
 		// initialize reader now, hopefully reusing one of the previous readers
 		si.reader = si.pool.GetReader(bytes.NewBuffer(si.origBytes))
 		si.bufReader = BufReaderPool.Get(si.reader)
+
+		if si.skip > 0 {
+			// This still decompresses through the skipped region -- no
+			// compressed-stream offset is recorded anywhere -- it just avoids
+			// decoding and allocating the entries within it.
+			if _, err := io.CopyN(io.Discard, si.bufReader, int64(si.skip)); err != nil {
+				si.err = errors.Wrap(err, "skipping to indexed offset")
+				si.Close()
+				return false
+			}
+			si.skip = 0
+		}
 	}
 
 	for {
-		ts, line, ok := si.moveNext()
+		ts, line, metadata, ok := si.moveNext()
 		if !ok {
 			si.Close()
 			return false
@@ -608,34 +1292,38 @@ func (si *bufferedIterator) Next() bool {
 		if si.filter != nil && !si.filter(line) {
 			continue
 		}
+		if si.metadataFilter != nil && !si.metadataFilter(metadataToMap(metadata)) {
+			continue
+		}
 		si.cur.Line = string(line)
 		si.cur.Timestamp = time.Unix(0, ts)
+		si.cur.StructuredMetadata = toLabelAdapters(metadata)
 		return true
 	}
 }
 
 // moveNext moves the buffer to the next entry
-func (si *bufferedIterator) moveNext() (int64, []byte, bool) {
+func (si *bufferedIterator) moveNext() (int64, []byte, []entryMetadata, bool) {
 	ts, err := binary.ReadVarint(si.bufReader)
 	if err != nil {
 		if err != io.EOF {
 			si.err = err
 		}
-		return 0, nil, false
+		return 0, nil, nil, false
 	}
 
 	l, err := binary.ReadUvarint(si.bufReader)
 	if err != nil {
 		if err != io.EOF {
 			si.err = err
-			return 0, nil, false
+			return 0, nil, nil, false
 		}
 	}
 	lineSize := int(l)
 
 	if lineSize >= maxLineLength {
 		si.err = fmt.Errorf("line too long %d, maximum %d", lineSize, maxLineLength)
-		return 0, nil, false
+		return 0, nil, nil, false
 	}
 	// If the buffer is not yet initialize or too small, we get a new one.
 	if si.buf == nil || lineSize > cap(si.buf) {
@@ -646,7 +1334,7 @@ func (si *bufferedIterator) moveNext() (int64, []byte, bool) {
 		si.buf = BytesBufferPool.Get(lineSize).([]byte)
 		if lineSize > cap(si.buf) {
 			si.err = fmt.Errorf("could not get a line buffer of size %d, actual %d", lineSize, cap(si.buf))
-			return 0, nil, false
+			return 0, nil, nil, false
 		}
 	}
 
@@ -654,17 +1342,52 @@ func (si *bufferedIterator) moveNext() (int64, []byte, bool) {
 	n, err := si.bufReader.Read(si.buf[:lineSize])
 	if err != nil && err != io.EOF {
 		si.err = err
-		return 0, nil, false
+		return 0, nil, nil, false
 	}
 	for n < lineSize {
 		r, err := si.bufReader.Read(si.buf[n:lineSize])
 		if err != nil {
 			si.err = err
-			return 0, nil, false
+			return 0, nil, nil, false
 		}
 		n += r
 	}
-	return ts, si.buf[:lineSize], true
+
+	var metadata []entryMetadata
+	if si.format >= chunkFormatV3 {
+		metadata, err = si.readMetadata()
+		if err != nil {
+			si.err = err
+			return 0, nil, nil, false
+		}
+	}
+
+	return ts, si.buf[:lineSize], metadata, true
+}
+
+// readMetadata decodes a chunkFormatV3 entry's structured key/value
+// metadata section, surfaced to callers via Entry().StructuredMetadata.
+func (si *bufferedIterator) readMetadata() ([]entryMetadata, error) {
+	n, err := binary.ReadUvarint(si.bufReader)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	metadata := make([]entryMetadata, 0, n)
+	for i := uint64(0); i < n; i++ {
+		key, err := readLenPrefixed(si.bufReader)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readLenPrefixed(si.bufReader)
+		if err != nil {
+			return nil, err
+		}
+		metadata = append(metadata, entryMetadata{key: key, value: value})
+	}
+	return metadata, nil
 }
 
 func (si *bufferedIterator) Entry() logproto.Entry {
@@ -0,0 +1,282 @@
+package chunkenc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+const gzipCompressionLevel = gzip.DefaultCompression
+
+// WriterPool is a pool of io.Writer that can be re-used.
+type WriterPool interface {
+	GetWriter(io.Writer) io.WriteCloser
+	PutWriter(io.WriteCloser)
+}
+
+// ReaderPool is a pool of io.Reader that can be re-used.
+type ReaderPool interface {
+	GetReader(io.Reader) io.Reader
+	PutReader(io.Reader)
+}
+
+var (
+	// None is the no-op pool, used for EncNone.
+	None NonePool
+	// Gzip is the gzip compression pool.
+	Gzip GzipPool
+	// Lz4 is the lz4 compression pool.
+	Lz4 Lz4Pool
+	// Snappy is the snappy compression pool.
+	Snappy SnappyPool
+	// Zstd is the zstd compression pool.
+	Zstd ZstdPool
+
+	// BytesBufferPool is a pool used to retrieve byte slices used to read/write line entries.
+	BytesBufferPool = sync.Pool{
+		New: func() interface{} { return make([]byte, 0, 1024) },
+	}
+
+	// BufReaderPool is a pool used to retrieve buffered readers.
+	BufReaderPool = &bufReaderPool{
+		pool: sync.Pool{
+			New: func() interface{} { return bufio.NewReader(nil) },
+		},
+	}
+
+	serializeBytesBufferPool = sync.Pool{
+		New: func() interface{} { return &bytes.Buffer{} },
+	}
+)
+
+func getWriterPool(enc Encoding) WriterPool {
+	switch enc {
+	case EncNone:
+		return &None
+	case EncGZIP:
+		return &Gzip
+	case EncLZ4:
+		return &Lz4
+	case EncSnappy:
+		return &Snappy
+	case EncZstd:
+		return &Zstd
+	default:
+		panic(fmt.Errorf("unknown encoding %v (%d)", enc, enc))
+	}
+}
+
+func getReaderPool(enc Encoding) ReaderPool {
+	switch enc {
+	case EncNone:
+		return &None
+	case EncGZIP:
+		return &Gzip
+	case EncLZ4:
+		return &Lz4
+	case EncSnappy:
+		return &Snappy
+	case EncZstd:
+		return &Zstd
+	default:
+		panic(fmt.Errorf("unknown encoding %v (%d)", enc, enc))
+	}
+}
+
+type bufReaderPool struct {
+	pool sync.Pool
+}
+
+func (p *bufReaderPool) Get(r io.Reader) *bufio.Reader {
+	buf := p.pool.Get().(*bufio.Reader)
+	buf.Reset(r)
+	return buf
+}
+
+func (p *bufReaderPool) Put(r *bufio.Reader) {
+	p.pool.Put(r)
+}
+
+// NonePool is the no-op pool for EncNone: blocks are stored uncompressed, so
+// there's nothing to pool and no codec state to reset between uses.
+type NonePool struct{}
+
+func (pool *NonePool) GetReader(src io.Reader) io.Reader {
+	return src
+}
+
+func (pool *NonePool) PutReader(_ io.Reader) {}
+
+func (pool *NonePool) GetWriter(dst io.Writer) io.WriteCloser {
+	return nopWriteCloser{dst}
+}
+
+func (pool *NonePool) PutWriter(_ io.WriteCloser) {}
+
+// nopWriteCloser adapts an io.Writer to io.WriteCloser with a no-op Close,
+// since EncNone has no compressed stream to flush.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// GzipPool is a gzip compression pool.
+type GzipPool struct {
+	readers sync.Pool
+	writers sync.Pool
+}
+
+func (pool *GzipPool) GetReader(src io.Reader) io.Reader {
+	if r := pool.readers.Get(); r != nil {
+		reader := r.(*gzip.Reader)
+		err := reader.Reset(src)
+		if err != nil {
+			panic(err)
+		}
+		return reader
+	}
+	reader, err := gzip.NewReader(src)
+	if err != nil {
+		panic(err)
+	}
+	return reader
+}
+
+func (pool *GzipPool) PutReader(reader io.Reader) {
+	pool.readers.Put(reader)
+}
+
+func (pool *GzipPool) GetWriter(dst io.Writer) io.WriteCloser {
+	if w := pool.writers.Get(); w != nil {
+		writer := w.(*gzip.Writer)
+		writer.Reset(dst)
+		return writer
+	}
+	level := gzipCompressionLevel
+	w, err := gzip.NewWriterLevel(dst, level)
+	if err != nil {
+		panic(err) // only happens with invalid compression levels
+	}
+	return w
+}
+
+func (pool *GzipPool) PutWriter(writer io.WriteCloser) {
+	pool.writers.Put(writer)
+}
+
+// Lz4Pool is an lz4 compression pool.
+type Lz4Pool struct {
+	readers sync.Pool
+	writers sync.Pool
+}
+
+func (pool *Lz4Pool) GetReader(src io.Reader) io.Reader {
+	if r := pool.readers.Get(); r != nil {
+		reader := r.(*lz4.Reader)
+		reader.Reset(src)
+		return reader
+	}
+	return lz4.NewReader(src)
+}
+
+func (pool *Lz4Pool) PutReader(reader io.Reader) {
+	pool.readers.Put(reader)
+}
+
+func (pool *Lz4Pool) GetWriter(dst io.Writer) io.WriteCloser {
+	if w := pool.writers.Get(); w != nil {
+		writer := w.(*lz4.Writer)
+		writer.Reset(dst)
+		return writer
+	}
+	return lz4.NewWriter(dst)
+}
+
+func (pool *Lz4Pool) PutWriter(writer io.WriteCloser) {
+	pool.writers.Put(writer)
+}
+
+// SnappyPool is a snappy compression pool.
+type SnappyPool struct {
+	readers sync.Pool
+	writers sync.Pool
+}
+
+func (pool *SnappyPool) GetReader(src io.Reader) io.Reader {
+	if r := pool.readers.Get(); r != nil {
+		reader := r.(*snappy.Reader)
+		reader.Reset(src)
+		return reader
+	}
+	return snappy.NewReader(src)
+}
+
+func (pool *SnappyPool) PutReader(reader io.Reader) {
+	pool.readers.Put(reader)
+}
+
+func (pool *SnappyPool) GetWriter(dst io.Writer) io.WriteCloser {
+	if w := pool.writers.Get(); w != nil {
+		writer := w.(*snappy.Writer)
+		writer.Reset(dst)
+		return writer
+	}
+	return snappy.NewBufferedWriter(dst)
+}
+
+func (pool *SnappyPool) PutWriter(writer io.WriteCloser) {
+	pool.writers.Put(writer)
+}
+
+// ZstdPool is a zstd compression pool. It uses klauspost/compress's
+// streaming encoder/decoder, which amortizes window allocation across
+// reuse the same way the gzip/lz4/snappy pools do.
+type ZstdPool struct {
+	readers sync.Pool
+	writers sync.Pool
+}
+
+func (pool *ZstdPool) GetReader(src io.Reader) io.Reader {
+	if r := pool.readers.Get(); r != nil {
+		reader := r.(*zstd.Decoder)
+		err := reader.Reset(src)
+		if err != nil {
+			panic(err)
+		}
+		return reader
+	}
+	reader, err := zstd.NewReader(src)
+	if err != nil {
+		panic(err)
+	}
+	return reader
+}
+
+func (pool *ZstdPool) PutReader(reader io.Reader) {
+	pool.readers.Put(reader)
+}
+
+func (pool *ZstdPool) GetWriter(dst io.Writer) io.WriteCloser {
+	if w := pool.writers.Get(); w != nil {
+		writer := w.(*zstd.Encoder)
+		writer.Reset(dst)
+		return writer
+	}
+	writer, err := zstd.NewWriter(dst, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	if err != nil {
+		panic(err)
+	}
+	return writer
+}
+
+func (pool *ZstdPool) PutWriter(writer io.WriteCloser) {
+	pool.writers.Put(writer)
+}
@@ -0,0 +1,76 @@
+package chunkenc
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+var benchmarkEncodings = []Encoding{EncGZIP, EncLZ4, EncSnappy, EncZstd}
+
+// benchmarkPayload approximates a batch of log lines: 512 copies of one
+// 114-byte line, about 57KiB in all.
+func benchmarkPayload() []byte {
+	line := []byte(`level=info ts=2026-07-26T12:00:00Z msg="request completed" method=GET path=/api/v1/foo status=200 duration=12.5ms` + "\n")
+	buf := make([]byte, 0, len(line)*512)
+	for i := 0; i < 512; i++ {
+		buf = append(buf, line...)
+	}
+	return buf
+}
+
+// BenchmarkWriterPool measures compression throughput for each supported
+// encoding except EncNone; used to pick the default encoding and
+// compression level.
+func BenchmarkWriterPool(b *testing.B) {
+	payload := benchmarkPayload()
+	for _, enc := range benchmarkEncodings {
+		enc := enc
+		b.Run(enc.String(), func(b *testing.B) {
+			pool := getWriterPool(enc)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var buf bytes.Buffer
+				w := pool.GetWriter(&buf)
+				if _, err := w.Write(payload); err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+				pool.PutWriter(w)
+			}
+		})
+	}
+}
+
+// BenchmarkReaderPool measures decompression throughput for each supported
+// encoding except EncNone.
+func BenchmarkReaderPool(b *testing.B) {
+	payload := benchmarkPayload()
+	for _, enc := range benchmarkEncodings {
+		enc := enc
+		b.Run(enc.String(), func(b *testing.B) {
+			writerPool := getWriterPool(enc)
+			var compressed bytes.Buffer
+			w := writerPool.GetWriter(&compressed)
+			if _, err := w.Write(payload); err != nil {
+				b.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				b.Fatal(err)
+			}
+			writerPool.PutWriter(w)
+
+			readerPool := getReaderPool(enc)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r := readerPool.GetReader(bytes.NewReader(compressed.Bytes()))
+				if _, err := io.Copy(io.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+				readerPool.PutReader(r)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package chunkenc
+
+import (
+	"testing"
+	"time"
+)
+
+// TestReorderBuffer_WithinWindow verifies an entry arriving behind the head
+// block's maxt, but within the configured window, is absorbed into
+// sideEntries instead of rejected with ErrOutOfOrder, and counted once the
+// block is cut.
+func TestReorderBuffer_WithinWindow(t *testing.T) {
+	c := NewMemChunkSize(EncNone, 1<<20, 0, WithReorderBuffer(5*time.Second, 16))
+
+	base := int64(1_700_000_000_000_000_000)
+	if err := c.append(base, "first", nil); err != nil {
+		t.Fatalf("append first: %v", err)
+	}
+	if err := c.append(base+int64(10*time.Second), "second", nil); err != nil {
+		t.Fatalf("append second: %v", err)
+	}
+	// Arrives 2s behind maxt (second), within the 5s window.
+	if err := c.append(base+int64(8*time.Second), "late-but-in-window", nil); err != nil {
+		t.Fatalf("append late-but-in-window: %v", err)
+	}
+
+	if len(c.head.sideEntries) != 1 {
+		t.Fatalf("expected 1 side entry, got %d", len(c.head.sideEntries))
+	}
+
+	if err := c.cut(); err != nil {
+		t.Fatalf("cut: %v", err)
+	}
+
+	if got, want := c.blocks[0].numEntries, 3; got != want {
+		t.Fatalf("numEntries = %d, want %d", got, want)
+	}
+}
+
+// TestReorderBuffer_ExceedsWindow verifies an entry arriving further behind
+// maxt than the configured window is still rejected with ErrOutOfOrder.
+func TestReorderBuffer_ExceedsWindow(t *testing.T) {
+	c := NewMemChunkSize(EncNone, 1<<20, 0, WithReorderBuffer(5*time.Second, 16))
+
+	base := int64(1_700_000_000_000_000_000)
+	if err := c.append(base, "first", nil); err != nil {
+		t.Fatalf("append first: %v", err)
+	}
+	if err := c.append(base+int64(10*time.Second), "second", nil); err != nil {
+		t.Fatalf("append second: %v", err)
+	}
+	// Arrives 9s behind maxt, outside the 5s window.
+	err := c.append(base+int64(1*time.Second), "too-late", nil)
+	if err != ErrOutOfOrder {
+		t.Fatalf("err = %v, want ErrOutOfOrder", err)
+	}
+}
+
+// TestReorderBuffer_ExceedsMaxEntries verifies the side buffer stops
+// absorbing out-of-order entries once maxEntries is reached, even for an
+// entry that would otherwise fit inside the window.
+func TestReorderBuffer_ExceedsMaxEntries(t *testing.T) {
+	c := NewMemChunkSize(EncNone, 1<<20, 0, WithReorderBuffer(5*time.Second, 1))
+
+	base := int64(1_700_000_000_000_000_000)
+	if err := c.append(base, "first", nil); err != nil {
+		t.Fatalf("append first: %v", err)
+	}
+	if err := c.append(base+int64(10*time.Second), "second", nil); err != nil {
+		t.Fatalf("append second: %v", err)
+	}
+	if err := c.append(base+int64(8*time.Second), "side-1", nil); err != nil {
+		t.Fatalf("append side-1: %v", err)
+	}
+	// The side buffer is already at maxEntries (1); this one must be rejected.
+	err := c.append(base+int64(9*time.Second), "side-2", nil)
+	if err != ErrOutOfOrder {
+		t.Fatalf("err = %v, want ErrOutOfOrder", err)
+	}
+}
+
+// TestHeadCutTransition verifies cut() resets the head block's reorder
+// state so the next block starts clean, that the head's cut flag is clear
+// afterwards (the chunk has no content-defined cutting, so the flag is never
+// set here), and that numEntries on the finished block accounts for merged
+// sideEntries.
+func TestHeadCutTransition(t *testing.T) {
+	c := NewMemChunkSize(EncNone, 1<<20, 0, WithReorderBuffer(5*time.Second, 16))
+
+	base := int64(1_700_000_000_000_000_000)
+	if err := c.append(base, "first", nil); err != nil {
+		t.Fatalf("append first: %v", err)
+	}
+	if err := c.append(base+int64(10*time.Second), "second", nil); err != nil {
+		t.Fatalf("append second: %v", err)
+	}
+	if err := c.append(base+int64(8*time.Second), "side", nil); err != nil {
+		t.Fatalf("append side: %v", err)
+	}
+
+	if err := c.cut(); err != nil {
+		t.Fatalf("cut: %v", err)
+	}
+
+	if !c.head.isEmpty() {
+		t.Fatalf("head block not reset after cut")
+	}
+	if len(c.head.sideEntries) != 0 {
+		t.Fatalf("sideEntries not reset after cut, got %d", len(c.head.sideEntries))
+	}
+	if c.head.cut {
+		t.Fatalf("head.cut flag not reset after cut")
+	}
+	if c.blocks[0].numEntries != 3 {
+		t.Fatalf("numEntries = %d, want 3", c.blocks[0].numEntries)
+	}
+
+	// The head is clean, so a fresh append should succeed rather than reject
+	// as out-of-order against the old head's state.
+	if err := c.append(base+int64(20*time.Second), "third", nil); err != nil {
+		t.Fatalf("append third after cut: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package chunkenc
+
+// rollingHash implements a bup/rsync-style rolling checksum over the last
+// cdcWindowSize bytes fed to it. It is used to find content-defined block
+// boundaries: a cut point is any position whose digest matches a caller
+// chosen mask, independent of where earlier bytes in the stream happened to
+// land.
+type rollingHash struct {
+	s1, s2 uint32
+	window [cdcWindowSize]byte
+	pos    int
+}
+
+const (
+	cdcWindowSize = 64
+	cdcCharOffset = 31
+)
+
+func newRollingHash() *rollingHash {
+	rh := &rollingHash{}
+	rh.reset()
+	return rh
+}
+
+// reset restores the rolling hash to the state of an empty window, as if it
+// had never seen any bytes.
+func (rh *rollingHash) reset() {
+	rh.s1 = cdcWindowSize * cdcCharOffset
+	rh.s2 = cdcWindowSize * (cdcWindowSize - 1) * cdcCharOffset
+	rh.window = [cdcWindowSize]byte{}
+	rh.pos = 0
+}
+
+// roll slides the window forward by one byte and returns the updated digest.
+func (rh *rollingHash) roll(b byte) uint32 {
+	drop := rh.window[rh.pos]
+	rh.window[rh.pos] = b
+	rh.pos = (rh.pos + 1) % cdcWindowSize
+
+	rh.s1 += uint32(b) - uint32(drop)
+	rh.s2 += rh.s1 - cdcWindowSize*(uint32(drop)+cdcCharOffset)
+
+	return rh.digest()
+}
+
+func (rh *rollingHash) digest() uint32 {
+	return rh.s1<<16 | (rh.s2 & 0xffff)
+}
@@ -0,0 +1,125 @@
+package chunkenc
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+)
+
+// encbuf is a helper type to populate a byte slice with various types.
+type encbuf struct {
+	b []byte
+	c [binary.MaxVarintLen64]byte
+}
+
+func (e *encbuf) reset()      { e.b = e.b[:0] }
+func (e *encbuf) get() []byte { return e.b }
+func (e *encbuf) len() int    { return len(e.b) }
+
+func (e *encbuf) putByte(b byte) { e.b = append(e.b, b) }
+
+func (e *encbuf) putBytes(b []byte) { e.b = append(e.b, b...) }
+
+func (e *encbuf) putBE32(x uint32) {
+	binary.BigEndian.PutUint32(e.c[:4], x)
+	e.b = append(e.b, e.c[:4]...)
+}
+
+func (e *encbuf) putBE64(x uint64) {
+	binary.BigEndian.PutUint64(e.c[:8], x)
+	e.b = append(e.b, e.c[:8]...)
+}
+
+func (e *encbuf) putBE64int(x int) { e.putBE64(uint64(x)) }
+
+func (e *encbuf) putUvarint(x int) {
+	n := binary.PutUvarint(e.c[:], uint64(x))
+	e.b = append(e.b, e.c[:n]...)
+}
+
+func (e *encbuf) putVarint64(x int64) {
+	n := binary.PutVarint(e.c[:], x)
+	e.b = append(e.b, e.c[:n]...)
+}
+
+// putHash appends a hash over the buffer's current contents to the buffer.
+func (e *encbuf) putHash(h hash.Hash32) {
+	h.Reset()
+	_, _ = h.Write(e.b)
+	e.putBE32(h.Sum32())
+}
+
+// decbuf provides safe methods to extract data from a byte slice. It does all
+// necessary bounds checking and advancing of the byte slice. Several datums
+// can be extracted without checking for errors. However, before using the
+// extracted results, the err() method must be checked.
+type decbuf struct {
+	b []byte
+	e error
+}
+
+func (d *decbuf) byte() byte {
+	if len(d.b) < 1 {
+		d.e = errInvalidSize
+		return 0
+	}
+	x := d.b[0]
+	d.b = d.b[1:]
+	return x
+}
+
+func (d *decbuf) be32() uint32 {
+	if len(d.b) < 4 {
+		d.e = errInvalidSize
+		return 0
+	}
+	x := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return x
+}
+
+func (d *decbuf) be64() uint64 {
+	if len(d.b) < 8 {
+		d.e = errInvalidSize
+		return 0
+	}
+	x := binary.BigEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return x
+}
+
+func (d *decbuf) uvarint() int {
+	return int(d.uvarint64())
+}
+
+func (d *decbuf) uvarint64() uint64 {
+	x, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.e = errInvalidSize
+		return 0
+	}
+	d.b = d.b[n:]
+	return x
+}
+
+func (d *decbuf) varint64() int64 {
+	x, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.e = errInvalidSize
+		return 0
+	}
+	d.b = d.b[n:]
+	return x
+}
+
+func (d *decbuf) crc32() uint32 {
+	return crc32.Checksum(d.b, castagnoliTable)
+}
+
+func (d *decbuf) err() error { return d.e }
+
+var errInvalidSize = errInvalidSizeErr("invalid size")
+
+type errInvalidSizeErr string
+
+func (e errInvalidSizeErr) Error() string { return string(e) }